@@ -0,0 +1,153 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command dubbo2istio synchronizes dubbo service providers registered in ZooKeeper and/or Nacos to the Istio
+// control plane as service entries.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	zkcontroller "github.com/aeraki-framework/double2istio/pkg/dubbo/zk/controller"
+	zkwatcher "github.com/aeraki-framework/double2istio/pkg/dubbo/zk/watcher"
+	nacoswatcher "github.com/aeraki-framework/double2istio/pkg/dubbo/nacos/watcher"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/nacos-group/nacos-sdk-go/v2/clients"
+	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	istioclient "istio.io/client-go/pkg/clientset/versioned"
+	"istio.io/pkg/log"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// defaultZkTimeout is the session timeout used when connecting to ZooKeeper
+const defaultZkTimeout = 10 * time.Second
+
+// defaultNamespace is the namespace tag/condition router DestinationRules and VirtualServices are written to
+const defaultNamespace = "istio-system"
+
+func main() {
+	zkAddr := flag.String("zk-addr", "", "comma separated ZooKeeper addresses, e.g. 127.0.0.1:2181")
+	nacosAddr := flag.String("nacos-addr", "", "Nacos server address, e.g. 127.0.0.1")
+	appDiscovery := flag.Bool("zk-application-discovery", false,
+		"watch Dubbo 3 application-level service discovery (/services/<app>) instead of interface-level providers")
+	leaderElect := flag.Bool("leader-elect", true,
+		"run leader election before reconciling ServiceEntries of ZooKeeper interface-level providers, so only one replica writes them at a time; "+
+			"router rules, application-level discovery and Nacos are synced by every replica regardless; disable for single-instance deployments")
+	podName := flag.String("pod-name", os.Getenv("POD_NAME"), "this replica's identity for leader election and the writer-identity annotation")
+	flag.Parse()
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(stop)
+	}()
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("failed to build kubernetes rest config: %v", err)
+	}
+	ic, err := istioclient.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("failed to build istio client: %v", err)
+	}
+	kc, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("failed to build kubernetes client: %v", err)
+	}
+
+	if *zkAddr != "" {
+		go runZkWatchers(ic, kc, *zkAddr, *appDiscovery, *leaderElect, *podName, stop)
+	}
+	if *nacosAddr != "" {
+		go runNacosWatchers(ic, *nacosAddr, stop)
+	}
+
+	<-stop
+}
+
+func runZkWatchers(ic *istioclient.Clientset, kc kubernetes.Interface, addr string, appDiscovery, leaderElect bool,
+	identity string, stop <-chan struct{}) {
+	conn, _, err := zk.Connect([]string{addr}, defaultZkTimeout)
+	if err != nil {
+		log.Errorf("failed to connect to zookeeper %s: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	if appDiscovery {
+		apps, _, err := conn.Children("/services")
+		if err != nil {
+			log.Errorf("failed to list dubbo applications under zookeeper %s: %v", addr, err)
+			return
+		}
+		for _, app := range apps {
+			watcher := zkwatcher.NewApplicationWatcher(ic, conn, app)
+			go watcher.Run(stop)
+		}
+		// keep conn open for the application watchers until stop closes
+		<-stop
+		return
+	}
+
+	services, _, err := conn.Children("/dubbo")
+	if err != nil {
+		log.Errorf("failed to list dubbo services under zookeeper %s: %v", addr, err)
+		return
+	}
+
+	ctrl := zkcontroller.NewController(ic, conn)
+	for _, service := range services {
+		ctrl.AddService(service, stop)
+
+		routerWatcher := zkwatcher.NewRouterWatcher(ic, conn, service, defaultNamespace)
+		go routerWatcher.Run(stop)
+	}
+	ctrl.RunWithLeaderElection(zkcontroller.LeaderElectionConfig{
+		Enabled:    leaderElect,
+		Namespace:  defaultNamespace,
+		LeaseName:  "dubbo2istio-controller",
+		Identity:   identity,
+		KubeClient: kc,
+	}, stop)
+}
+
+func runNacosWatchers(ic *istioclient.Clientset, addr string, stop <-chan struct{}) {
+	client, err := clients.CreateNamingClient(map[string]interface{}{
+		"serverConfigs": []constant.ServerConfig{*constant.NewServerConfig(addr, 8848)},
+		"clientConfig":  *constant.NewClientConfig(),
+	})
+	if err != nil {
+		log.Errorf("failed to create nacos naming client for %s: %v", addr, err)
+		return
+	}
+
+	services, err := client.GetAllServicesInfo(vo.GetAllServiceInfoParam{})
+	if err != nil {
+		log.Errorf("failed to list dubbo services from nacos %s: %v", addr, err)
+		return
+	}
+	for _, service := range services.Doms {
+		watcher := nacoswatcher.NewProviderWatcher(ic, client, service)
+		go watcher.Run(stop)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nacos watches changes on dubbo service providers registered in Nacos and synchronizes them to the Istio
+// control plane, mirroring the ZooKeeper watcher in pkg/dubbo/zk/watcher.
+package nacos
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/model"
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/router"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	model2 "github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/clientset/versioned"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// aerakiFieldManager is the FieldManager for Aeraki CRDs
+	aerakiFieldManager = "aeraki"
+
+	// debounceAfter is the delay added to events to wait after a registry event for debouncing.
+	// This will delay the push by at least this interval, plus the time getting subsequent events.
+	// If no change is detected the push will happen, otherwise we'll keep delaying until things settle.
+	debounceAfter = 500 * time.Millisecond
+
+	// debounceMax is the maximum time to wait for events while debouncing.
+	// Defaults to 10 seconds. If events keep showing up with no break for this time, we'll trigger a push.
+	debounceMax = 10 * time.Second
+
+	// the maximum retries if failed to sync dubbo services to Istio
+	maxRetries = 10
+
+	// groupName is the Nacos group dubbo providers are registered under
+	groupName = "DEFAULT_GROUP"
+)
+
+// ProviderWatcher watches changes on dubbo service providers published to Nacos and synchronizes the changed dubbo
+// providers to the Istio control plane via service entries. It implements the same contract as
+// pkg/dubbo/zk/watcher.ProviderWatcher so the two registries can be run side by side.
+type ProviderWatcher struct {
+	service string
+	client  naming_client.INamingClient
+	ic      *istioclient.Clientset
+
+	mu             sync.Mutex
+	serviceEntryNS map[string]string //key name, value namespace
+
+	updates chan []string
+
+	// subParam is the exact *vo.SubscribeParam passed to client.Subscribe in subscribeUntilSuccess. Nacos matches
+	// subscriptions by the callback function value stored on this param, so Unsubscribe must be called with this
+	// same pointer rather than a freshly built one with a new callback closure, or the unsubscribe silently no-ops.
+	subParam *vo.SubscribeParam
+}
+
+// NewProviderWatcher creates a ProviderWatcher that subscribes to "providers:<service>" on Nacos
+func NewProviderWatcher(ic *istioclient.Clientset, client naming_client.INamingClient, service string) *ProviderWatcher {
+	return &ProviderWatcher{
+		service:        service,
+		client:         client,
+		ic:             ic,
+		serviceEntryNS: make(map[string]string, 0),
+		updates:        make(chan []string, 1),
+	}
+}
+
+// Run starts the ProviderWatcher until it receives a message over the stop channel
+// This method blocks the caller
+func (w *ProviderWatcher) Run(stop <-chan struct{}) {
+	var timeChan <-chan time.Time
+	var startDebounce time.Time
+	var lastResourceUpdateTime time.Time
+	var providers []string
+	debouncedEvents := 0
+	syncCounter := 0
+
+	providers = w.subscribeUntilSuccess()
+	w.syncService2IstioUntilMaxRetries(w.service, providers)
+
+	for {
+		select {
+		case p := <-w.updates:
+			providers = p
+			lastResourceUpdateTime = time.Now()
+			if debouncedEvents == 0 {
+				log.Debugf("This is the first debounced event")
+				startDebounce = lastResourceUpdateTime
+			}
+			debouncedEvents++
+			timeChan = time.After(debounceAfter)
+		case <-timeChan:
+			log.Debugf("Receive event from time chanel")
+			eventDelay := time.Since(startDebounce)
+			quietTime := time.Since(lastResourceUpdateTime)
+			// it has been too long since the first debounced event or quiet enough since the last debounced event
+			if eventDelay >= debounceMax || quietTime >= debounceAfter {
+				if debouncedEvents > 0 {
+					syncCounter++
+					log.Infof("Sync %s debounce stable[%d] %d: %v since last change, %v since last push",
+						w.service, syncCounter, debouncedEvents, quietTime, eventDelay)
+					w.syncService2IstioUntilMaxRetries(w.service, providers)
+					debouncedEvents = 0
+				}
+			} else {
+				timeChan = time.After(debounceAfter - quietTime)
+			}
+		case <-stop:
+			_ = w.client.Unsubscribe(w.subParam)
+			return
+		}
+	}
+}
+
+// subscribeUntilSuccess subscribes to the dubbo provider instances for w.service, retrying until the initial
+// subscription and instance list succeed.
+func (w *ProviderWatcher) subscribeUntilSuccess() []string {
+	param := w.subscribeParam()
+	w.subParam = param
+	for {
+		instances, err := w.client.SelectInstances(vo.SelectInstancesParam{
+			ServiceName: param.ServiceName,
+			GroupName:   param.GroupName,
+			HealthyOnly: true,
+		})
+		if err != nil {
+			log.Errorf("failed to fetch nacos instances for %s, %v", w.service, err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err := w.client.Subscribe(param); err != nil {
+			log.Errorf("failed to subscribe to nacos service %s, %v", w.service, err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		return instancesToProviders(w.service, instances)
+	}
+}
+
+// subscribeParam builds the Nacos subscription descriptor for "providers:<interface>", pushing instance list
+// changes back onto w.updates via the SubscribeCallback.
+func (w *ProviderWatcher) subscribeParam() *vo.SubscribeParam {
+	return &vo.SubscribeParam{
+		ServiceName: "providers:" + w.service,
+		GroupName:   groupName,
+		SubscribeCallback: func(services []model2.Instance, err error) {
+			if err != nil {
+				log.Errorf("nacos push callback error for %s, %v", w.service, err)
+				return
+			}
+			w.updates <- instancesToProviders(w.service, services)
+		},
+	}
+}
+
+func (w *ProviderWatcher) syncService2IstioUntilMaxRetries(service string, providers []string) {
+	err := w.syncService2Istio(w.service, providers)
+	retries := 0
+	for err != nil {
+		if isRetryableError(err) && retries < maxRetries {
+			log.Errorf("Failed to synchronize dubbo services to Istio, error: %v,  retrying %v ...", err, retries)
+			err = w.syncService2Istio(w.service, providers)
+			retries++
+		} else {
+			log.Errorf("Failed to synchronize dubbo services to Istio: %v", err)
+			return
+		}
+	}
+}
+
+func (w *ProviderWatcher) syncService2Istio(service string, providers []string) error {
+	new, err := model.ConvertServiceEntry(service, providers)
+	if err != nil {
+		return err
+	}
+	router.StampTagLabels(new, providers)
+
+	if serviceHasNoEndpoints(new) {
+		log.Infof("found dubbo service without providers : %s, delete the corresponding service entry",
+			new.Name)
+		return w.deleteServiceEntry(new.Name)
+	}
+
+	w.mu.Lock()
+	oldNS, exist := w.serviceEntryNS[new.Name]
+	w.mu.Unlock()
+	if exist && oldNS != new.Namespace {
+		log.Errorf("found service entry %s in two namespaces : %s %s ,delete the older one %s/%s", new.Name, oldNS,
+			new.Namespace, oldNS, new.Name)
+		if err := w.ic.NetworkingV1alpha3().ServiceEntries(oldNS).Delete(context.TODO(), new.Name,
+			metav1.DeleteOptions{}); err != nil {
+			if isRealError(err) {
+				log.Errorf("failed to delete service entry: %s/%s", oldNS, new.Name)
+			}
+		}
+	}
+
+	existingServiceEntry, err := w.ic.NetworkingV1alpha3().ServiceEntries(new.Namespace).Get(context.TODO(), new.Name,
+		metav1.GetOptions{},
+	)
+
+	if isRealError(err) {
+		return err
+	} else if isNotFound(err) {
+		return w.createServiceEntry(new)
+	}
+	return w.updateServiceEntry(new, existingServiceEntry)
+}
+
+func (w *ProviderWatcher) createServiceEntry(serviceEntry *v1alpha3.ServiceEntry) error {
+	_, err := w.ic.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Create(context.TODO(), serviceEntry,
+		metav1.CreateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		w.mu.Lock()
+		w.serviceEntryNS[serviceEntry.Name] = serviceEntry.Namespace
+		w.mu.Unlock()
+		log.Infof("service entry %s has been created: %s", serviceEntry.Name, serviceEntry.Name)
+	}
+	return err
+}
+
+func (w *ProviderWatcher) deleteServiceEntry(name string) error {
+	w.mu.Lock()
+	ns, exist := w.serviceEntryNS[name]
+	w.mu.Unlock()
+	if !exist {
+		serviceEntryList, err := w.ic.NetworkingV1alpha3().ServiceEntries("").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list service entry: %v", err)
+		}
+		for _, serviceEntry := range serviceEntryList.Items {
+			if serviceEntry.Name == name {
+				ns = serviceEntry.Namespace
+				break
+			}
+		}
+	}
+
+	if ns == "" {
+		log.Infof("service entry %s/%s doesn't exist", ns, name)
+		return nil
+	}
+	err := w.ic.NetworkingV1alpha3().ServiceEntries(ns).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err == nil {
+		w.mu.Lock()
+		delete(w.serviceEntryNS, name)
+		w.mu.Unlock()
+		log.Infof("service entry %s/%s has been deleted", ns, name)
+	} else if isNotFound(err) {
+		log.Infof("service entry %s/%s doesn't exist", ns, name)
+	}
+	return nil
+}
+
+func (w *ProviderWatcher) updateServiceEntry(new *v1alpha3.ServiceEntry, old *v1alpha3.ServiceEntry) error {
+	new.Spec.Ports = old.Spec.Ports
+	new.ResourceVersion = old.ResourceVersion
+	_, err := w.ic.NetworkingV1alpha3().ServiceEntries(new.Namespace).Update(context.TODO(), new,
+		metav1.UpdateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		log.Infof("service entry %s has been updated: %s", new.Name, new.Name)
+	}
+	return err
+}
+
+func isRealError(err error) bool {
+	return err != nil && !errors.IsNotFound(err)
+}
+
+func isRetryableError(err error) bool {
+	return errors.IsInternalError(err) || errors.IsResourceExpired(err) || errors.IsServerTimeout(err) ||
+		errors.IsServiceUnavailable(err) || errors.IsTimeout(err) || errors.IsTooManyRequests(err) ||
+		errors.ReasonForError(err) == metav1.StatusReasonUnknown
+}
+
+func isNotFound(err error) bool {
+	return err != nil && errors.IsNotFound(err)
+}
+
+func serviceHasNoEndpoints(serviceEntry *v1alpha3.ServiceEntry) bool {
+	return len(serviceEntry.Spec.Endpoints) == 0
+}
+
+// instancesToProviders rebuilds dubbo provider URLs out of Nacos instances so they can be fed into the same
+// model.ConvertServiceEntry path the ZooKeeper watcher uses. Dubbo-on-Nacos doesn't register a single URL string:
+// each instance carries its ip/port plus the dubbo URL params spread across Metadata (protocol, interface, group,
+// version, methods, ...), the same way the ZK watcher's provider node encodes them as query params.
+func instancesToProviders(service string, instances []model2.Instance) []string {
+	providers := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		protocol := instance.Metadata["protocol"]
+		if protocol == "" {
+			protocol = "dubbo"
+		}
+		iface := instance.Metadata["interface"]
+		if iface == "" {
+			iface = service
+		}
+
+		params := url.Values{}
+		for k, v := range instance.Metadata {
+			if k == "protocol" || k == "interface" {
+				continue
+			}
+			params.Set(k, v)
+		}
+
+		providers = append(providers, fmt.Sprintf("%s://%s:%d/%s?%s", protocol, instance.Ip, instance.Port, iface,
+			params.Encode()))
+	}
+	return providers
+}
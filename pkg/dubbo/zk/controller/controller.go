@@ -0,0 +1,320 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package controller reconciles Dubbo services watched over ZooKeeper into Istio ServiceEntries using a
+// client-go style workqueue, replacing the one-goroutine-per-service debounce loop in pkg/dubbo/zk/watcher with a
+// single shared event source feeding a bounded worker pool.
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/model"
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/router"
+
+	"github.com/go-zookeeper/zk"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/clientset/versioned"
+	istioinformers "istio.io/client-go/pkg/informers/externalversions"
+	networkinglister "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// aerakiFieldManager is the FieldManager for Aeraki CRDs
+	aerakiFieldManager = "aeraki"
+
+	// debounceAfter is how long the queue waits after a zk event before the key becomes visible to a worker,
+	// giving a burst of rapid registry churn on the same service a chance to collapse into one reconcile.
+	debounceAfter = 500 * time.Millisecond
+
+	// maxRetries is the maximum number of requeues the rate limiter will allow for a given key before it's dropped
+	maxRetries = 10
+
+	// defaultWorkers is the number of goroutines draining the workqueue, independent of how many services are
+	// being watched
+	defaultWorkers = 10
+
+	// informerResyncPeriod periodically re-lists ServiceEntries to self-heal the lister's cache
+	informerResyncPeriod = 10 * time.Minute
+)
+
+// Controller watches every configured Dubbo service over a single ZooKeeper connection and reconciles the changed
+// ones into Istio ServiceEntries. Unlike watcher.ProviderWatcher, which debounces and reconciles inside its own
+// goroutine per service, Controller feeds all zk watch events into one workqueue.RateLimitingInterface drained by a
+// fixed-size worker pool. Each watched service still has one goroutine of its own holding its zk watch (see
+// AddService); only the reconcile work is bounded by the pool size.
+type Controller struct {
+	conn    *zk.Conn
+	ic      *istioclient.Clientset
+	queue   workqueue.RateLimitingInterface
+	workers int
+
+	// dequeued fans out c.queue.Get() to whichever workers are currently running, via the single dispatcher
+	// goroutine started in NewController. Workers come and go across leader election terms, but that dispatcher
+	// goroutine is the only thing that ever calls queue.Get(), so leadership transitions never accumulate
+	// goroutines blocked waiting on the shared queue. It's closed once the dispatcher observes queue.ShutDown().
+	dequeued chan interface{}
+
+	// identity identifies this replica (normally pod name/uid), stamped onto every ServiceEntry it writes so a
+	// stale leader's writes can be spotted and reconciled after a failover. Set via RunWithLeaderElection.
+	identity string
+
+	informerFactory istioinformers.SharedInformerFactory
+	seLister        networkinglister.ServiceEntryLister
+	seSynced        cache.InformerSynced
+}
+
+// NewController creates a Controller that reconciles Dubbo services into Istio ServiceEntries
+func NewController(ic *istioclient.Clientset, conn *zk.Conn) *Controller {
+	informerFactory := istioinformers.NewSharedInformerFactory(ic, informerResyncPeriod)
+	seInformer := informerFactory.Networking().V1alpha3().ServiceEntries()
+
+	c := &Controller{
+		conn:            conn,
+		ic:              ic,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		workers:         defaultWorkers,
+		dequeued:        make(chan interface{}),
+		informerFactory: informerFactory,
+		seLister:        seInformer.Lister(),
+		seSynced:        seInformer.Informer().HasSynced,
+	}
+	go c.dispatch()
+	return c
+}
+
+// dispatch is the single long-lived goroutine that ever calls c.queue.Get(). It forwards each dequeued key to
+// c.dequeued, where it's picked up by whichever worker is currently selecting on it, and exits once the queue is
+// shut down. Workers themselves never call queue.Get() directly, so starting/stopping worker pools across leader
+// election terms can't leak goroutines blocked on an idle shared queue.
+func (c *Controller) dispatch() {
+	for {
+		key, shutdown := c.queue.Get()
+		if shutdown {
+			close(c.dequeued)
+			return
+		}
+		c.dequeued <- key
+	}
+}
+
+// AddService starts watching service over ZooKeeper until stop is closed, enqueuing its key whenever the provider
+// list changes. This replaces the per-service goroutine spawned by watcher.NewProviderWatcher(...).Run: AddService
+// only starts a thin forwarding goroutine, all reconcile work happens on the shared worker pool.
+func (c *Controller) AddService(service string, stop <-chan struct{}) {
+	go c.watchService(service, stop)
+}
+
+// watchService re-arms a ChildrenW watch on service's provider path, pushing a debounced key onto the queue every
+// time the watch fires, until stop is closed
+func (c *Controller) watchService(service string, stop <-chan struct{}) {
+	path := "/dubbo/" + service + "/providers"
+	for {
+		_, _, eventChan, err := c.conn.ChildrenW(path)
+		if err != nil {
+			log.Errorf("failed to watch zookeeper path %s, %v", path, err)
+			select {
+			case <-time.After(1 * time.Second):
+				continue
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-eventChan:
+			// AddAfter coalesces with any pending add for the same key already sitting in the delaying queue,
+			// giving the same debounce behaviour ProviderWatcher's timer implemented by hand.
+			c.queue.AddAfter(service, debounceAfter)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Run starts the informer cache and the reconcile worker pool. This method blocks the caller.
+func (c *Controller) Run(stop <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	c.informerFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, c.seSynced) {
+		log.Errorf("failed to sync service entry informer cache")
+		return
+	}
+
+	for i := 0; i < c.workers; i++ {
+		go c.runWorker(stop)
+	}
+	<-stop
+}
+
+// runWorker drains the queue until stop is closed or the queue itself is shut down, whichever happens first. Taking
+// stop explicitly (rather than relying solely on queue.ShutDown()) lets RunWithLeaderElection stop a leadership
+// term's workers without shutting down the shared queue, which other leadership terms still need to feed and drain.
+func (c *Controller) runWorker(stop <-chan struct{}) {
+	for c.processNextWorkItem(stop) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(stop <-chan struct{}) bool {
+	key, shutdown := c.getWorkItem(stop)
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	service := key.(string)
+	if err := c.reconcile(service); err != nil {
+		if c.queue.NumRequeues(key) < maxRetries {
+			log.Errorf("failed to reconcile dubbo service %s, requeuing: %v", service, err)
+			c.queue.AddRateLimited(key)
+			return true
+		}
+		log.Errorf("failed to reconcile dubbo service %s, giving up after %d retries: %v", service, maxRetries, err)
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// getWorkItem waits for the dispatcher goroutine to hand over the next key, but also unblocks when stop is closed,
+// returning shutdown=true. It never calls queue.Get() itself, so repeatedly starting and stopping worker pools
+// across leader election terms doesn't accumulate goroutines blocked on an idle shared queue.
+func (c *Controller) getWorkItem(stop <-chan struct{}) (interface{}, bool) {
+	select {
+	case <-stop:
+		return nil, true
+	case key, ok := <-c.dequeued:
+		return key, !ok
+	}
+}
+
+// reconcile fetches the current provider list for service and syncs the corresponding ServiceEntry, the same
+// create/update/delete logic watcher.ProviderWatcher.syncService2Istio implements.
+func (c *Controller) reconcile(service string) error {
+	providers, _, err := c.conn.Children("/dubbo/" + service + "/providers")
+	if err != nil {
+		return err
+	}
+
+	new, err := model.ConvertServiceEntry(service, providers)
+	if err != nil {
+		return err
+	}
+	router.StampTagLabels(new, providers)
+
+	if len(new.Spec.Endpoints) == 0 {
+		log.Infof("found dubbo service without providers : %s, delete the corresponding service entry", new.Name)
+		return c.deleteServiceEntry(new.Name)
+	}
+
+	existing, err := c.lookupServiceEntry(new.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return c.createServiceEntry(new)
+	}
+	if existing.Namespace != new.Namespace {
+		log.Errorf("found service entry %s in two namespaces : %s %s ,deleting the older one", new.Name,
+			existing.Namespace, new.Namespace)
+		if err := c.ic.NetworkingV1alpha3().ServiceEntries(existing.Namespace).Delete(context.TODO(), new.Name,
+			metav1.DeleteOptions{}); err != nil && isRealError(err) {
+			return err
+		}
+		return c.createServiceEntry(new)
+	}
+	return c.updateServiceEntry(new, existing)
+}
+
+// lookupServiceEntry finds the ServiceEntry for name via the informer-backed lister rather than the in-memory map
+// ProviderWatcher kept, so a Controller restart doesn't lose track of where each ServiceEntry lives.
+func (c *Controller) lookupServiceEntry(name string) (*v1alpha3.ServiceEntry, error) {
+	all, err := c.seLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, se := range all {
+		if se.Name == name {
+			return se, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *Controller) createServiceEntry(serviceEntry *v1alpha3.ServiceEntry) error {
+	c.stampIdentity(serviceEntry)
+	_, err := c.ic.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Create(context.TODO(), serviceEntry,
+		metav1.CreateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		log.Infof("service entry %s has been created", serviceEntry.Name)
+	}
+	return err
+}
+
+func (c *Controller) updateServiceEntry(new, old *v1alpha3.ServiceEntry) error {
+	new.Spec.Ports = old.Spec.Ports
+	new.ResourceVersion = old.ResourceVersion
+	c.stampIdentity(new)
+	_, err := c.ic.NetworkingV1alpha3().ServiceEntries(new.Namespace).Update(context.TODO(), new,
+		metav1.UpdateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		log.Infof("service entry %s has been updated", new.Name)
+	}
+	return err
+}
+
+func (c *Controller) deleteServiceEntry(name string) error {
+	existing, err := c.lookupServiceEntry(name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		log.Infof("service entry %s doesn't exist", name)
+		return nil
+	}
+	err = c.ic.NetworkingV1alpha3().ServiceEntries(existing.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err == nil {
+		log.Infof("service entry %s/%s has been deleted", existing.Namespace, name)
+	} else if isNotFound(err) {
+		log.Infof("service entry %s/%s doesn't exist", existing.Namespace, name)
+		return nil
+	}
+	return err
+}
+
+// stampIdentity records which replica is writing serviceEntry, so a stale leader's writes can be identified after
+// a failover. It's a no-op when c.identity is empty, whether or not leader election is enabled.
+func (c *Controller) stampIdentity(serviceEntry *v1alpha3.ServiceEntry) {
+	if c.identity == "" {
+		return
+	}
+	if serviceEntry.Annotations == nil {
+		serviceEntry.Annotations = make(map[string]string, 1)
+	}
+	serviceEntry.Annotations[identityAnnotation] = c.identity
+}
+
+func isRealError(err error) bool {
+	return err != nil && !errors.IsNotFound(err)
+}
+
+func isNotFound(err error) bool {
+	return err != nil && errors.IsNotFound(err)
+}
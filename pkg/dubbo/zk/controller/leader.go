@@ -0,0 +1,157 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+var leaderTransitionsTotal = monitoring.NewSum(
+	"dubbo2istio_leader_transitions_total",
+	"Number of times this process has transitioned between leader and follower",
+)
+
+// LeaderElectionConfig configures HA leader election for a Controller. When Enabled is false, Run behaves as if
+// this replica always holds the lease, so single-instance deployments pay no leaderelection overhead.
+type LeaderElectionConfig struct {
+	// Enabled turns leader election on. Followers keep their ZooKeeper watches and ServiceEntry lister warm but
+	// don't run reconcile workers, so failover doesn't need to rebuild any state from scratch.
+	Enabled bool
+	// Namespace is the namespace the coordination.k8s.io/v1 Lease is created in, normally the controller's own
+	// install namespace.
+	Namespace string
+	// LeaseName is the name of the Lease the replicas coordinate on.
+	LeaseName string
+	// Identity identifies this replica in the Lease's holder identity and in the identity annotation stamped on
+	// every ServiceEntry this replica writes, so stale ownership can be reconciled after a failover.
+	Identity string
+	// KubeClient is used to create/update the coordination Lease. Istio CRDs are written through c.ic, this is a
+	// plain Kubernetes client for the Lease object only.
+	KubeClient kubernetes.Interface
+}
+
+// identityAnnotation records which controller replica last wrote a ServiceEntry, in case a stale leader's writes
+// need to be reconciled after a failover.
+const identityAnnotation = "dubbo2istio.aeraki.io/writer-identity"
+
+// RunWithLeaderElection runs the Controller's informer and zk watches unconditionally (so followers stay warm),
+// but only runs the reconcile worker pool while this replica holds the Lease named by cfg.
+func (c *Controller) RunWithLeaderElection(cfg LeaderElectionConfig, stop <-chan struct{}) {
+	c.identity = cfg.Identity
+
+	if !cfg.Enabled {
+		c.Run(stop)
+		return
+	}
+
+	c.informerFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, c.seSynced) {
+		log.Errorf("failed to sync service entry informer cache")
+		return
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      cfg.LeaseName,
+			Namespace: cfg.Namespace,
+		},
+		Client: cfg.KubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: cfg.Identity,
+		},
+	}
+
+	// ctx is cancelled when stop closes, so losing the outer stop signal releases the lease and returns
+	// RunOrDie instead of leaving it running forever against a background context.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	// leading is 1 while this replica holds the lease. client-go calls OnStoppedLeading on every return from
+	// RunOrDie, also for a replica that never led, so only a set flag counts as a leader -> follower transition.
+	var leading int32
+
+	electionConfig := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   defaultLeaseDuration,
+		RenewDeadline:   defaultRenewDeadline,
+		RetryPeriod:     defaultRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			// OnStartedLeading can run again after OnStoppedLeading if this replica loses and later
+			// re-acquires the lease, so the worker pool and its stop signal must be created fresh on every
+			// call rather than shared across leadership terms.
+			OnStartedLeading: func(leCtx context.Context) {
+				atomic.StoreInt32(&leading, 1)
+				leaderTransitionsTotal.Increment()
+				log.Infof("%s became leader, starting reconcile workers", cfg.Identity)
+
+				var workers sync.WaitGroup
+				workers.Add(c.workers)
+				for i := 0; i < c.workers; i++ {
+					go func() {
+						defer workers.Done()
+						c.runWorker(leCtx.Done())
+					}()
+				}
+
+				// leCtx is cancelled as soon as this replica loses the lease (or the outer ctx is
+				// cancelled), so block here until the workers this term started have returned. client-go
+				// runs this callback in its own goroutine, so OnStoppedLeading is not ordered after it and
+				// may run while these workers are still finishing an in-flight reconcile.
+				<-leCtx.Done()
+				workers.Wait()
+			},
+			OnStoppedLeading: func() {
+				if atomic.SwapInt32(&leading, 0) != 1 {
+					return
+				}
+				leaderTransitionsTotal.Increment()
+				log.Infof("%s is no longer leader, reconcile workers stopped", cfg.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != cfg.Identity {
+					log.Infof("%s observed new leader: %s", cfg.Identity, identity)
+				}
+			},
+		},
+	}
+
+	// RunOrDie returns once this replica loses the lease or ctx is cancelled; after a lost lease, run for the lease
+	// again as a follower so a later term can start, until stop closes.
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, electionConfig)
+	}
+}
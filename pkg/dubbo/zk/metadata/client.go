@@ -0,0 +1,75 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metadata talks to the Dubbo MetadataService exposed by application-level service discovery instances,
+// resolving the interfaces, ports and params an instance exports.
+package metadata
+
+import (
+	"fmt"
+
+	"dubbo.apache.org/dubbo-go/v3/client"
+	"dubbo.apache.org/dubbo-go/v3/protocol/triple"
+)
+
+// ServiceInfo is a single interface exported by a dubbo instance, as returned by MetadataService.getMetadataInfo
+type ServiceInfo struct {
+	Name     string            `json:"name"`
+	Group    string            `json:"group"`
+	Version  string            `json:"version"`
+	Protocol string            `json:"protocol"`
+	Port     int               `json:"port"`
+	Params   map[string]string `json:"params"`
+}
+
+// MetadataInfo is the payload returned by an instance's MetadataService.getMetadataInfo invocation
+type MetadataInfo struct {
+	App      string                 `json:"app"`
+	Revision string                 `json:"revision"`
+	Services map[string]ServiceInfo `json:"services"`
+}
+
+// Client fetches MetadataInfo from a Dubbo 3 application instance
+type Client interface {
+	// GetMetadataInfo invokes MetadataService.getMetadataInfo on the given instance (host:port) over Dubbo/Triple
+	GetMetadataInfo(host string, port int) (*MetadataInfo, error)
+}
+
+// tripleClient is the default Client implementation, invoking MetadataService generically over Triple
+type tripleClient struct{}
+
+// NewClient creates a metadata Client that invokes MetadataService over Dubbo/Triple
+func NewClient() Client {
+	return &tripleClient{}
+}
+
+// GetMetadataInfo connects to the instance's MetadataService port and invokes getMetadataInfo generically, the
+// same way the Dubbo SDKs resolve application-level service discovery metadata.
+func (c *tripleClient) GetMetadataInfo(host string, port int) (*MetadataInfo, error) {
+	conn, err := triple.NewClient(
+		fmt.Sprintf("%s:%d", host, port),
+		client.WithClientProtocolTriple(),
+		client.WithClientInterface("org.apache.dubbo.metadata.MetadataService"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial metadata service at %s:%d: %v", host, port, err)
+	}
+	defer conn.Close()
+
+	info := &MetadataInfo{}
+	if err := conn.CallUnary("getMetadataInfo", []interface{}{"" /* default revision */}, info); err != nil {
+		return nil, fmt.Errorf("failed to invoke getMetadataInfo on %s:%d: %v", host, port, err)
+	}
+	return info, nil
+}
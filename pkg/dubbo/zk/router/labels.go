@@ -0,0 +1,58 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net/url"
+
+	istiov1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+)
+
+// tagParam is the dubbo provider URL query param a tag router rule is matched against
+const tagParam = "dubbo.tag"
+
+// StampTagLabels stamps the "tag" label BuildDestinationRule's subsets select endpoints by onto each endpoint of
+// serviceEntry, read from the dubbo.tag param of the provider URL that endpoint was built from. Every watcher that
+// writes a ServiceEntry (ZK interface-level, ZK application-level, Nacos) should call this so tag routing works
+// regardless of which registry the providers came from.
+func StampTagLabels(serviceEntry *istiov1alpha3.ServiceEntry, providers []string) {
+	tagByHost := make(map[string]string, len(providers))
+	for _, provider := range providers {
+		raw := provider
+		if unescaped, err := url.QueryUnescape(provider); err == nil {
+			raw = unescaped
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if tag := u.Query().Get(tagParam); tag != "" {
+			tagByHost[u.Hostname()] = tag
+		}
+	}
+	if len(tagByHost) == 0 {
+		return
+	}
+	for _, endpoint := range serviceEntry.Spec.Endpoints {
+		tag, ok := tagByHost[endpoint.Address]
+		if !ok {
+			continue
+		}
+		if endpoint.Labels == nil {
+			endpoint.Labels = make(map[string]string, 1)
+		}
+		endpoint.Labels["tag"] = tag
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package router converts Dubbo tag router and condition router rules into the Istio DestinationRule and
+// VirtualService that implement the same routing decision in the mesh.
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	istiov1alpha3 "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultSubset is the subset name used when no tag router rule is in effect, routing to every endpoint
+const defaultSubset = "all"
+
+// unsupportedWhenKeys are Dubbo condition-router "when" keys that describe the invocation itself (which method was
+// called, which application/host the consumer is) rather than anything carried as an HTTP header on the request.
+// They have no faithful Istio HTTPMatchRequest equivalent, so mapping them to a header match would silently
+// produce a VirtualService that never matches the traffic it's meant to select. Only consumer-side attachment
+// params the mesh's Dubbo/Triple filter forwards as HTTP headers are translated; these are skipped instead.
+var unsupportedWhenKeys = map[string]struct{}{
+	"method":      {},
+	"application": {},
+	"host":        {},
+}
+
+// TagRuleAddress is a single tag -> addresses mapping in a Dubbo tag router rule
+type TagRuleAddress struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Match     []Match  `json:"match,omitempty"`
+}
+
+// Match is a consumer-side parameter match condition attached to a tag rule or a condition rule
+type Match struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// TagRouteRule is the YAML body stored under /dubbo/config/dubbo/<service>.tag-router
+type TagRouteRule struct {
+	Force   bool             `json:"force"`
+	Runtime bool             `json:"runtime"`
+	Enabled bool             `json:"enabled"`
+	Tags    []TagRuleAddress `json:"tags"`
+}
+
+// ConditionRouteRule is the YAML body stored under /dubbo/config/dubbo/<service>.condition-router
+type ConditionRouteRule struct {
+	Force      bool     `json:"force"`
+	Runtime    bool     `json:"runtime"`
+	Enabled    bool     `json:"enabled"`
+	Conditions []string `json:"conditions"`
+}
+
+// condition is a single parsed "<when> => <then>" entry of a ConditionRouteRule
+type condition struct {
+	when string
+	then string
+}
+
+// ParseTagRule unmarshals the YAML body of a Dubbo tag router rule
+func ParseTagRule(data []byte) (*TagRouteRule, error) {
+	rule := &TagRouteRule{}
+	if err := yaml.Unmarshal(data, rule); err != nil {
+		return nil, fmt.Errorf("failed to parse tag router rule: %v", err)
+	}
+	return rule, nil
+}
+
+// ParseConditionRule unmarshals the YAML body of a Dubbo condition router rule
+func ParseConditionRule(data []byte) (*ConditionRouteRule, error) {
+	rule := &ConditionRouteRule{}
+	if err := yaml.Unmarshal(data, rule); err != nil {
+		return nil, fmt.Errorf("failed to parse condition router rule: %v", err)
+	}
+	return rule, nil
+}
+
+// BuildDestinationRule builds the DestinationRule for service, one subset per tag plus the defaultSubset that
+// matches every endpoint. Subsets select endpoints by the "tag" label the ServiceEntry writer stamps from the
+// provider URL's dubbo.tag param.
+func BuildDestinationRule(namespace, service string, rule *TagRouteRule) *istiov1alpha3.DestinationRule {
+	subsets := []*v1alpha3.Subset{
+		{
+			Name:   defaultSubset,
+			Labels: map[string]string{},
+		},
+	}
+	if rule != nil && rule.Enabled {
+		for _, tag := range rule.Tags {
+			subsets = append(subsets, &v1alpha3.Subset{
+				Name:   tag.Name,
+				Labels: map[string]string{"tag": tag.Name},
+			})
+		}
+	}
+
+	return &istiov1alpha3.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service,
+			Namespace: namespace,
+		},
+		Spec: v1alpha3.DestinationRule{
+			Host:    service,
+			Subsets: subsets,
+		},
+	}
+}
+
+// BuildVirtualService builds the VirtualService for service, expressing the condition rule's consumer -> provider
+// selection as http.match / route.destination.subset. Deleting the condition rule (rule == nil or disabled) rolls
+// routing back to the defaultSubset, i.e. every consumer reaches every provider. tagRule is the same service's tag
+// router rule (may be nil/disabled): it determines which subsets actually exist on the DestinationRule
+// BuildDestinationRule produces, so a condition rule selecting a tag that rule doesn't define falls back to
+// defaultSubset instead of the VirtualService referencing a subset that was never created.
+func BuildVirtualService(namespace, service string, tagRule *TagRouteRule,
+	conditionRule *ConditionRouteRule) *istiov1alpha3.VirtualService {
+	subsets := knownSubsets(tagRule)
+
+	var routes []*v1alpha3.HTTPRoute
+	if conditionRule != nil && conditionRule.Enabled {
+		for _, raw := range conditionRule.Conditions {
+			cond := parseCondition(raw)
+			routes = append(routes, &v1alpha3.HTTPRoute{
+				Match: matchFromWhen(cond.when),
+				Route: []*v1alpha3.HTTPRouteDestination{
+					{
+						Destination: &v1alpha3.Destination{
+							Host:   service,
+							Subset: subsetFromThen(cond.then, subsets),
+						},
+					},
+				},
+			})
+		}
+	}
+	routes = append(routes, &v1alpha3.HTTPRoute{
+		Route: []*v1alpha3.HTTPRouteDestination{
+			{
+				Destination: &v1alpha3.Destination{
+					Host:   service,
+					Subset: defaultSubset,
+				},
+			},
+		},
+	})
+
+	return &istiov1alpha3.VirtualService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service,
+			Namespace: namespace,
+		},
+		Spec: v1alpha3.VirtualService{
+			Hosts: []string{service},
+			Http:  routes,
+		},
+	}
+}
+
+// knownSubsets is the set of subset names BuildDestinationRule would produce for tagRule: defaultSubset plus one
+// per enabled tag.
+func knownSubsets(tagRule *TagRouteRule) map[string]struct{} {
+	subsets := map[string]struct{}{defaultSubset: {}}
+	if tagRule != nil && tagRule.Enabled {
+		for _, tag := range tagRule.Tags {
+			subsets[tag.Name] = struct{}{}
+		}
+	}
+	return subsets
+}
+
+// parseCondition splits a single "<when> => <then>" condition rule entry
+func parseCondition(raw string) condition {
+	parts := strings.SplitN(raw, "=>", 2)
+	if len(parts) != 2 {
+		return condition{when: strings.TrimSpace(raw)}
+	}
+	return condition{when: strings.TrimSpace(parts[0]), then: strings.TrimSpace(parts[1])}
+}
+
+// matchFromWhen turns a Dubbo condition "when" clause (a list of "key = value" consumer-side parameter matches
+// joined by "&") into an Istio HTTPMatchRequest, skipping any key in unsupportedWhenKeys rather than mapping it to
+// a header match that wouldn't actually select the intended traffic.
+func matchFromWhen(when string) []*v1alpha3.HTTPMatchRequest {
+	if when == "" {
+		return nil
+	}
+	headers := map[string]*v1alpha3.StringMatch{}
+	for _, clause := range strings.Split(when, "&") {
+		kv := strings.SplitN(clause, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		if _, unsupported := unsupportedWhenKeys[key]; unsupported {
+			log.Errorf("condition router \"when\" key %q has no Istio header equivalent, skipping", key)
+			continue
+		}
+		headers[key] = &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Exact{Exact: value}}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return []*v1alpha3.HTTPMatchRequest{{Headers: headers}}
+}
+
+// subsetFromThen extracts the provider-side "tag" value out of a Dubbo condition "then" clause, falling back to
+// defaultSubset when the rule doesn't select a tag or selects one that isn't in subsets, i.e. one the
+// DestinationRule doesn't actually define a subset for.
+func subsetFromThen(then string, subsets map[string]struct{}) string {
+	for _, clause := range strings.Split(then, "&") {
+		kv := strings.SplitN(clause, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "dubbo.tag" {
+			tag := strings.TrimSpace(kv[1])
+			if _, known := subsets[tag]; known {
+				return tag
+			}
+			log.Errorf("condition router rule selects tag %q which has no matching destination rule subset, "+
+				"falling back to %q", tag, defaultSubset)
+			return defaultSubset
+		}
+	}
+	return defaultSubset
+}
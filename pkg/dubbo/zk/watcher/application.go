@@ -0,0 +1,308 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zk
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/metadata"
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/model"
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/router"
+
+	"github.com/go-zookeeper/zk"
+	"istio.io/client-go/pkg/apis/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/clientset/versioned"
+	"istio.io/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metadataServiceURLParamsKey is the instance metadata key Dubbo 3 application-level discovery uses to advertise
+// the ports its MetadataService listens on, keyed by protocol, e.g. {"tri":{"port":"20881"}}.
+const metadataServiceURLParamsKey = "dubbo.metadata-service.url-params"
+
+// serviceInstance is the JSON payload stored in the data of each "/services/<app>/<instance>" znode, as published
+// by Dubbo 3 application-level service discovery. The znode's child name is just an opaque instance id, not a
+// host:port pair.
+type serviceInstance struct {
+	ID       string            `json:"id"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ApplicationWatcher watches the Dubbo 3 application-level service discovery node for a single application
+// (/services/<app>), resolves the interfaces each instance exports via the instance's MetadataService, and
+// synchronizes one ServiceEntry per interface to the Istio control plane, the same way ProviderWatcher does for
+// interface-level discovery.
+type ApplicationWatcher struct {
+	app            string
+	path           string
+	conn           *zk.Conn
+	ic             *istioclient.Clientset
+	metadataClient metadata.Client
+	serviceEntryNS map[string]string // key interface name, value namespace
+
+	// lastInterfaces is the set of interfaces this application exported as of the previous sync, used to garbage
+	// collect interfaces whose last hosting instance has disappeared.
+	lastInterfaces map[string]struct{}
+}
+
+// NewApplicationWatcher creates an ApplicationWatcher for the given application name
+func NewApplicationWatcher(ic *istioclient.Clientset, conn *zk.Conn, app string) *ApplicationWatcher {
+	return &ApplicationWatcher{
+		app:            app,
+		path:           "/services/" + app,
+		conn:           conn,
+		ic:             ic,
+		metadataClient: metadata.NewClient(),
+		serviceEntryNS: make(map[string]string, 0),
+		lastInterfaces: make(map[string]struct{}, 0),
+	}
+}
+
+// Run starts the ApplicationWatcher until it receives a message over the stop channel. This method blocks the
+// caller, following the same debounce semantics as ProviderWatcher.Run.
+func (w *ApplicationWatcher) Run(stop <-chan struct{}) {
+	var timeChan <-chan time.Time
+	var startDebounce time.Time
+	var lastResourceUpdateTime time.Time
+	debouncedEvents := 0
+	syncCounter := 0
+
+	instances, eventChan := watchUntilSuccess(w.path, w.conn)
+	w.syncApplicationUntilMaxRetries(instances)
+
+	for {
+		select {
+		case <-eventChan:
+			lastResourceUpdateTime = time.Now()
+			if debouncedEvents == 0 {
+				log.Debugf("This is the first debounced event")
+				startDebounce = lastResourceUpdateTime
+			}
+			debouncedEvents++
+			timeChan = time.After(debounceAfter)
+			instances, eventChan = watchUntilSuccess(w.path, w.conn)
+		case <-timeChan:
+			log.Debugf("Receive event from time chanel")
+			eventDelay := time.Since(startDebounce)
+			quietTime := time.Since(lastResourceUpdateTime)
+			if eventDelay >= debounceMax || quietTime >= debounceAfter {
+				if debouncedEvents > 0 {
+					syncCounter++
+					log.Infof("Sync app %s debounce stable[%d] %d: %v since last change, %v since last push",
+						w.app, syncCounter, debouncedEvents, quietTime, eventDelay)
+					w.syncApplicationUntilMaxRetries(instances)
+					debouncedEvents = 0
+				}
+			} else {
+				timeChan = time.After(debounceAfter - quietTime)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *ApplicationWatcher) syncApplicationUntilMaxRetries(instances []string) {
+	err := w.syncApplication(instances)
+	retries := 0
+	for err != nil {
+		if isRetryableError(err) && retries < maxRetries {
+			log.Errorf("Failed to synchronize dubbo application %s to Istio, error: %v, retrying %v ...",
+				w.app, err, retries)
+			err = w.syncApplication(instances)
+			retries++
+		} else {
+			log.Errorf("Failed to synchronize dubbo application %s to Istio: %v", w.app, err)
+			return
+		}
+	}
+}
+
+// syncApplication resolves the interfaces exported by every live instance of w.app through MetadataService, fans
+// the providers discovered for each interface into model.ConvertServiceEntry, and garbage-collects interfaces that
+// no instance exports anymore.
+func (w *ApplicationWatcher) syncApplication(instances []string) error {
+	providersByInterface := make(map[string][]string)
+	resolvedAllInstances := true
+
+	for _, instance := range instances {
+		data, _, err := w.conn.Get(w.path + "/" + instance)
+		if err != nil {
+			log.Errorf("failed to read application instance node %s/%s: %v", w.path, instance, err)
+			resolvedAllInstances = false
+			continue
+		}
+		var si serviceInstance
+		if err := json.Unmarshal(data, &si); err != nil {
+			log.Errorf("failed to decode application instance node %s/%s: %v", w.path, instance, err)
+			resolvedAllInstances = false
+			continue
+		}
+
+		host, port := metadataServiceEndpoint(si)
+		info, err := w.metadataClient.GetMetadataInfo(host, port)
+		if err != nil {
+			log.Errorf("failed to fetch metadata info from instance %s of app %s: %v", instance, w.app, err)
+			resolvedAllInstances = false
+			continue
+		}
+
+		for _, svc := range info.Services {
+			provider := buildProviderURL(host, svc)
+			providersByInterface[svc.Name] = append(providersByInterface[svc.Name], provider)
+		}
+	}
+
+	currentInterfaces := make(map[string]struct{}, len(providersByInterface))
+	for iface, providers := range providersByInterface {
+		currentInterfaces[iface] = struct{}{}
+		if err := w.syncInterface(iface, providers); err != nil {
+			return err
+		}
+	}
+
+	if !resolvedAllInstances {
+		// Some instances couldn't be read or queried this round, so currentInterfaces may be missing interfaces
+		// that are still genuinely exported. Skip GC rather than deleting their ServiceEntries on a transient
+		// blip, but still remember the interfaces we did resolve so a later, fully-resolved round can still GC
+		// the ones that are actually gone.
+		log.Errorf("app %s: not all instances resolved this round, skipping interface garbage collection", w.app)
+		for iface := range currentInterfaces {
+			w.lastInterfaces[iface] = struct{}{}
+		}
+		return nil
+	}
+
+	// garbage-collect interfaces no live instance exports anymore
+	for iface := range w.lastInterfaces {
+		if _, stillExported := currentInterfaces[iface]; !stillExported {
+			if err := w.syncInterface(iface, nil); err != nil {
+				return err
+			}
+		}
+	}
+	w.lastInterfaces = currentInterfaces
+	return nil
+}
+
+func (w *ApplicationWatcher) syncInterface(iface string, providers []string) error {
+	new, err := model.ConvertServiceEntry(iface, providers)
+	if err != nil {
+		return err
+	}
+	router.StampTagLabels(new, providers)
+
+	if serviceHasNoEndpoints(new) {
+		log.Infof("found dubbo interface without providers : %s, delete the corresponding service entry", new.Name)
+		return w.deleteServiceEntry(new.Name)
+	}
+
+	existingServiceEntry, err := w.ic.NetworkingV1alpha3().ServiceEntries(new.Namespace).Get(context.TODO(), new.Name,
+		metav1.GetOptions{},
+	)
+	if isRealError(err) {
+		return err
+	} else if isNotFound(err) {
+		return w.createServiceEntry(new)
+	}
+	return w.updateServiceEntry(new, existingServiceEntry)
+}
+
+func (w *ApplicationWatcher) createServiceEntry(serviceEntry *v1alpha3.ServiceEntry) error {
+	_, err := w.ic.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Create(context.TODO(), serviceEntry,
+		metav1.CreateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		w.serviceEntryNS[serviceEntry.Name] = serviceEntry.Namespace
+		log.Infof("service entry %s has been created: %s", serviceEntry.Name, struct2JSON(serviceEntry))
+	}
+	return err
+}
+
+func (w *ApplicationWatcher) updateServiceEntry(new *v1alpha3.ServiceEntry, old *v1alpha3.ServiceEntry) error {
+	new.Spec.Ports = old.Spec.Ports
+	new.ResourceVersion = old.ResourceVersion
+	_, err := w.ic.NetworkingV1alpha3().ServiceEntries(new.Namespace).Update(context.TODO(), new,
+		metav1.UpdateOptions{FieldManager: aerakiFieldManager})
+	if err == nil {
+		w.serviceEntryNS[new.Name] = new.Namespace
+		log.Infof("service entry %s has been updated: %s", new.Name, struct2JSON(new))
+	}
+	return err
+}
+
+func (w *ApplicationWatcher) deleteServiceEntry(name string) error {
+	ns, exist := w.serviceEntryNS[name]
+	if !exist {
+		return nil
+	}
+	err := w.ic.NetworkingV1alpha3().ServiceEntries(ns).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err == nil {
+		delete(w.serviceEntryNS, name)
+		log.Infof("service entry %s/%s has been deleted", ns, name)
+	} else if isNotFound(err) {
+		log.Infof("service entry %s/%s doesn't exist", ns, name)
+	}
+	return nil
+}
+
+// metadataServiceEndpoint resolves the host/port MetadataService listens on for si. The MetadataService normally
+// runs on a different port than the instance's main service port, advertised via the
+// dubbo.metadata-service.url-params instance metadata as {"<protocol>":{"port":"<port>", ...}, ...}. Falling back
+// to the instance's own host/port keeps working against non-conforming registrations.
+func metadataServiceEndpoint(si serviceInstance) (string, int) {
+	raw, ok := si.Metadata[metadataServiceURLParamsKey]
+	if !ok {
+		return si.Host, si.Port
+	}
+
+	var byProtocol map[string]map[string]string
+	if err := json.Unmarshal([]byte(raw), &byProtocol); err != nil {
+		log.Errorf("failed to parse %s for instance %s: %v", metadataServiceURLParamsKey, si.ID, err)
+		return si.Host, si.Port
+	}
+	for _, params := range byProtocol {
+		portStr, ok := params["port"]
+		if !ok {
+			continue
+		}
+		if port, err := strconv.Atoi(portStr); err == nil {
+			return si.Host, port
+		}
+	}
+	return si.Host, si.Port
+}
+
+// buildProviderURL reconstructs a dubbo provider URL for svc hosted at host, in the same shape ZooKeeper
+// interface-level discovery publishes under /dubbo/<service>/providers, so it can be fed into the shared
+// model.ConvertServiceEntry path.
+func buildProviderURL(host string, svc metadata.ServiceInfo) string {
+	protocol := svc.Protocol
+	if protocol == "" {
+		protocol = "tri"
+	}
+	params := url.Values{}
+	params.Set("group", svc.Group)
+	params.Set("version", svc.Version)
+	for k, v := range svc.Params {
+		params.Set(k, v)
+	}
+	return protocol + "://" + host + ":" + strconv.Itoa(svc.Port) + "/" + svc.Name + "?" + params.Encode()
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/model"
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/router"
 
 	"github.com/go-zookeeper/zk"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
@@ -48,7 +49,11 @@ const (
 )
 
 // ProviderWatcher watches changes on dubbo service providers and synchronize the changed dubbo providers to the Istio
-// control plane via service entries
+// control plane via service entries.
+//
+// Deprecated: spawning one ProviderWatcher per interface doesn't scale to large deployments, each one holds its
+// own zk watch and debounce timer goroutine. New deployments should use pkg/dubbo/zk/controller.Controller, which
+// multiplexes every watched service through a single workqueue-backed worker pool.
 type ProviderWatcher struct {
 	service        string
 	path           string
@@ -134,6 +139,7 @@ func (w *ProviderWatcher) syncService2Istio(service string, providers []string)
 	if err != nil {
 		return err
 	}
+	router.StampTagLabels(new, providers)
 
 	// delete the corresponding service entry because all the endpoints have been deleted.
 	if serviceHasNoEndpoints(new) {
@@ -0,0 +1,203 @@
+// Copyright Aeraki Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zk
+
+import (
+	"context"
+	"time"
+
+	"github.com/aeraki-framework/double2istio/pkg/dubbo/zk/router"
+
+	"github.com/go-zookeeper/zk"
+	istioclient "istio.io/client-go/pkg/clientset/versioned"
+	"istio.io/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// tagRouterSuffix is the ZK node suffix dubbo tag router rules are published under
+	tagRouterSuffix = ".tag-router"
+	// conditionRouterSuffix is the ZK node suffix dubbo condition router rules are published under
+	conditionRouterSuffix = ".condition-router"
+)
+
+// RouterWatcher watches a Dubbo service's tag router and condition router config rules and translates them into
+// an Istio DestinationRule (one subset per tag) and VirtualService (consumer -> provider routing). Deleting a rule
+// rolls the corresponding routing back to the default all-in-one subset.
+type RouterWatcher struct {
+	service   string
+	namespace string
+	configDir string
+	conn      *zk.Conn
+	ic        *istioclient.Clientset
+}
+
+// NewRouterWatcher creates a RouterWatcher for service, watching rules under
+// /dubbo/config/dubbo/<service>.tag-router and /dubbo/config/dubbo/<service>.condition-router
+func NewRouterWatcher(ic *istioclient.Clientset, conn *zk.Conn, service, namespace string) *RouterWatcher {
+	return &RouterWatcher{
+		service:   service,
+		namespace: namespace,
+		configDir: "/dubbo/config/dubbo",
+		conn:      conn,
+		ic:        ic,
+	}
+}
+
+// Run starts the RouterWatcher until it receives a message over the stop channel. This method blocks the caller.
+func (w *RouterWatcher) Run(stop <-chan struct{}) {
+	tagEvents := w.watchRule(w.service + tagRouterSuffix)
+	conditionEvents := w.watchRule(w.service + conditionRouterSuffix)
+
+	w.sync()
+	for {
+		select {
+		case <-tagEvents:
+			tagEvents = w.watchRule(w.service + tagRouterSuffix)
+			w.sync()
+		case <-conditionEvents:
+			conditionEvents = w.watchRule(w.service + conditionRouterSuffix)
+			w.sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watchRule arms a watch on node and returns the channel it fires on. Most services never have a tag/condition
+// router rule, so node usually doesn't exist yet: ExistsW (unlike GetW) can set a watch on a missing node and
+// fires it once the node is created, instead of erroring with zk.ErrNoNode that would otherwise force an endless
+// 1s retry loop for every watched service that has no rule.
+func (w *RouterWatcher) watchRule(node string) <-chan zk.Event {
+	path := w.configDir + "/" + node
+	for {
+		_, _, eventChan, err := w.conn.ExistsW(path)
+		if err == nil {
+			return eventChan
+		}
+		log.Errorf("failed to watch zookeeper path %s, %v", path, err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (w *RouterWatcher) sync() {
+	tagRule, err := w.readTagRule()
+	if err != nil {
+		log.Errorf("failed to read tag router rule for %s: %v", w.service, err)
+		return
+	}
+	conditionRule, err := w.readConditionRule()
+	if err != nil {
+		log.Errorf("failed to read condition router rule for %s: %v", w.service, err)
+		return
+	}
+
+	// Most Dubbo services never get a tag or condition router rule. Only materialize a DestinationRule/
+	// VirtualService once there's actual Dubbo routing config for this service, instead of writing default
+	// all-in-one-subset objects for every watched interface; clean up anything left over from a rule that was
+	// since deleted.
+	if tagRule == nil && conditionRule == nil {
+		if err := w.deleteDestinationRule(); err != nil {
+			log.Errorf("failed to delete destination rule for %s: %v", w.service, err)
+		}
+		if err := w.deleteVirtualService(); err != nil {
+			log.Errorf("failed to delete virtual service for %s: %v", w.service, err)
+		}
+		return
+	}
+
+	if err := w.applyDestinationRule(tagRule); err != nil {
+		log.Errorf("failed to apply destination rule for %s: %v", w.service, err)
+	}
+	if err := w.applyVirtualService(tagRule, conditionRule); err != nil {
+		log.Errorf("failed to apply virtual service for %s: %v", w.service, err)
+	}
+}
+
+func (w *RouterWatcher) readTagRule() (*router.TagRouteRule, error) {
+	data, _, err := w.conn.Get(w.configDir + "/" + w.service + tagRouterSuffix)
+	if isZkNoNode(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return router.ParseTagRule(data)
+}
+
+func (w *RouterWatcher) readConditionRule() (*router.ConditionRouteRule, error) {
+	data, _, err := w.conn.Get(w.configDir + "/" + w.service + conditionRouterSuffix)
+	if isZkNoNode(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return router.ParseConditionRule(data)
+}
+
+func (w *RouterWatcher) applyDestinationRule(rule *router.TagRouteRule) error {
+	desired := router.BuildDestinationRule(w.namespace, w.service, rule)
+	existing, err := w.ic.NetworkingV1alpha3().DestinationRules(w.namespace).Get(context.TODO(), w.service,
+		metav1.GetOptions{})
+	if isNotFound(err) {
+		_, err := w.ic.NetworkingV1alpha3().DestinationRules(w.namespace).Create(context.TODO(), desired,
+			metav1.CreateOptions{FieldManager: aerakiFieldManager})
+		return err
+	} else if isRealError(err) {
+		return err
+	}
+	desired.ResourceVersion = existing.ResourceVersion
+	_, err = w.ic.NetworkingV1alpha3().DestinationRules(w.namespace).Update(context.TODO(), desired,
+		metav1.UpdateOptions{FieldManager: aerakiFieldManager})
+	return err
+}
+
+func (w *RouterWatcher) applyVirtualService(tagRule *router.TagRouteRule, conditionRule *router.ConditionRouteRule) error {
+	desired := router.BuildVirtualService(w.namespace, w.service, tagRule, conditionRule)
+	existing, err := w.ic.NetworkingV1alpha3().VirtualServices(w.namespace).Get(context.TODO(), w.service,
+		metav1.GetOptions{})
+	if isNotFound(err) {
+		_, err := w.ic.NetworkingV1alpha3().VirtualServices(w.namespace).Create(context.TODO(), desired,
+			metav1.CreateOptions{FieldManager: aerakiFieldManager})
+		return err
+	} else if isRealError(err) {
+		return err
+	}
+	desired.ResourceVersion = existing.ResourceVersion
+	_, err = w.ic.NetworkingV1alpha3().VirtualServices(w.namespace).Update(context.TODO(), desired,
+		metav1.UpdateOptions{FieldManager: aerakiFieldManager})
+	return err
+}
+
+func (w *RouterWatcher) deleteDestinationRule() error {
+	err := w.ic.NetworkingV1alpha3().DestinationRules(w.namespace).Delete(context.TODO(), w.service,
+		metav1.DeleteOptions{})
+	if isRealError(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *RouterWatcher) deleteVirtualService() error {
+	err := w.ic.NetworkingV1alpha3().VirtualServices(w.namespace).Delete(context.TODO(), w.service,
+		metav1.DeleteOptions{})
+	if isRealError(err) {
+		return err
+	}
+	return nil
+}
+
+func isZkNoNode(err error) bool {
+	return err == zk.ErrNoNode
+}